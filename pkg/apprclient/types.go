@@ -0,0 +1,18 @@
+package apprclient
+
+// RegistryMetadata captures the identifying coordinates of an operator
+// bundle as returned by a registry source (namespace/name/release) along
+// with a content digest used to detect when a bundle has changed.
+type RegistryMetadata struct {
+	Namespace string
+	Name      string
+	Release   string
+	Digest    string
+}
+
+// OperatorMetadata pairs a bundle's RegistryMetadata with the raw tarball
+// bytes fetched from the registry.
+type OperatorMetadata struct {
+	RegistryMetadata
+	Blob []byte
+}
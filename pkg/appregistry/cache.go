@@ -0,0 +1,296 @@
+package appregistry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flattenedCacheFile marks a cache entry that holds a single flattened
+// bundle document rather than an extracted nested tree.
+const flattenedCacheFile = "flattened.yaml"
+
+// BundleCache is an on-disk, content-addressable cache of already
+// extracted bundle trees, keyed by apprclient.RegistryMetadata.Digest so
+// repeated pulls of an unchanged bundle skip re-extraction entirely.
+// Entries are laid out as <dir>/<namespace>/<name>/<digest>/ and evicted
+// least-recently-used once the cache exceeds maxSize bytes, the same
+// shape BuildKit's cache manager uses for its own blob cache.
+//
+// Get/Put/evict are safe for concurrent use: mu serialises them, and
+// inUse pins entries a concurrent Get has handed out so evict never
+// removes a directory a caller is still reading, the same lease pattern
+// BuildKit uses to keep eviction safe under concurrent access.
+type BundleCache struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+	inUse   map[string]int
+}
+
+// NewBundleCache returns a BundleCache rooted at dir, creating it if
+// necessary. A maxSize of 0 disables eviction.
+func NewBundleCache(dir string, maxSize int64) (*BundleCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create cache directory %s: %s", dir, err)
+	}
+
+	return &BundleCache{dir: dir, maxSize: maxSize}, nil
+}
+
+func (c *BundleCache) entryDir(namespace, name, digest string) string {
+	return filepath.Join(c.dir, namespace, name, digest)
+}
+
+// Get returns the path to a cached entry for (namespace, name, digest),
+// touching its access time so it is not the next eviction candidate, and
+// pinning it so a concurrent evict cannot remove it out from under the
+// caller. The caller must call Release(dir) once it is done reading the
+// entry.
+func (c *BundleCache) Get(namespace, name, digest string) (string, bool) {
+	dir := c.entryDir(namespace, name, digest)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := os.Stat(dir); err != nil {
+		return "", false
+	}
+
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+
+	if c.inUse == nil {
+		c.inUse = map[string]int{}
+	}
+	c.inUse[dir]++
+
+	return dir, true
+}
+
+// Release unpins a cache entry previously returned by Get, allowing evict
+// to remove it again once nothing else holds a reference to it.
+func (c *BundleCache) Release(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.inUse[dir] <= 1 {
+		delete(c.inUse, dir)
+		return
+	}
+	c.inUse[dir]--
+}
+
+// Put populates a new cache entry for (namespace, name, digest) by
+// calling write with a scratch directory, then atomically publishes it by
+// renaming into place, and finally evicts least-recently-accessed entries
+// until the cache is back under its size budget.
+func (c *BundleCache) Put(namespace, name, digest string, write func(dir string) error) error {
+	dest := c.entryDir(namespace, name, digest)
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(dest), digest+".tmp-")
+	if err != nil {
+		return err
+	}
+
+	if err := write(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A concurrent Put already published this content-addressed entry.
+	if _, err := os.Stat(dest); err == nil {
+		os.RemoveAll(tmp)
+		return nil
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	now := time.Now()
+	os.Chtimes(dest, now, now)
+
+	if c.maxSize > 0 {
+		return c.evict()
+	}
+
+	return nil
+}
+
+type cacheEntry struct {
+	path       string
+	size       int64
+	accessedAt time.Time
+}
+
+// evict removes cache entries in least-recently-accessed order until the
+// cache's total size is back at or below maxSize. Entries currently
+// pinned by an in-flight Get are skipped even if they would otherwise be
+// next in line, since removing one out from under a concurrent reader
+// would turn a legitimate cache hit into a spurious extraction failure.
+// Callers must hold c.mu.
+func (c *BundleCache) evict() error {
+	namespaces, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	var entries []cacheEntry
+	var total int64
+
+	for _, ns := range namespaces {
+		namespaceDir := filepath.Join(c.dir, ns.Name())
+
+		names, err := ioutil.ReadDir(namespaceDir)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			nameDir := filepath.Join(namespaceDir, name.Name())
+
+			digests, err := ioutil.ReadDir(nameDir)
+			if err != nil {
+				return err
+			}
+
+			for _, digest := range digests {
+				// Skip scratch directories of a Put still writing
+				// outside c.mu; they are not published entries.
+				if strings.Contains(digest.Name(), ".tmp-") {
+					continue
+				}
+
+				path := filepath.Join(nameDir, digest.Name())
+
+				size, err := dirSize(path)
+				if err != nil {
+					return err
+				}
+
+				info, err := os.Stat(path)
+				if err != nil {
+					return err
+				}
+
+				entries = append(entries, cacheEntry{path: path, size: size, accessedAt: info.ModTime()})
+				total += size
+			}
+		}
+	}
+
+	if total <= c.maxSize {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].accessedAt.Before(entries[j].accessedAt)
+	})
+
+	for _, entry := range entries {
+		if total <= c.maxSize {
+			break
+		}
+
+		if c.inUse[entry.path] > 0 {
+			continue
+		}
+
+		if err := os.RemoveAll(entry.path); err != nil {
+			return err
+		}
+
+		total -= entry.size
+	}
+
+	return nil
+}
+
+func dirSize(root string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
+
+// linkTree materialises src into dest, hard-linking each regular file
+// where possible and falling back to a copy across filesystem
+// boundaries. It honours ctx, aborting promptly if it is cancelled
+// partway through a large tree.
+func linkTree(ctx context.Context, src, dest string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		target := filepath.Join(dest, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		if err := os.Link(path, target); err == nil {
+			return nil
+		}
+
+		return copyFile(ctx, path, target, info.Mode())
+	})
+}
+
+func copyFile(ctx context.Context, src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, ctxReader{ctx: ctx, r: in})
+	return err
+}
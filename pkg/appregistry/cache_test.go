@@ -0,0 +1,63 @@
+package appregistry
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBundleCacheDoesNotEvictAPinnedEntry(t *testing.T) {
+	dir, remove := setupDownloadFolder(t)
+	defer remove()
+
+	// A ten-byte budget holds exactly one of the ten-byte entries below,
+	// so any second entry forces evict() to try to reclaim space.
+	cache, err := NewBundleCache(dir, 10)
+	require.NoError(t, err)
+
+	write := func(content string) func(dir string) error {
+		return func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "data"), []byte(content), 0644)
+		}
+	}
+
+	require.NoError(t, cache.Put("ns", "pinned", "digest-a", write("aaaaaaaaaa")))
+
+	entryDir, hit := cache.Get("ns", "pinned", "digest-a")
+	require.True(t, hit)
+
+	require.NoError(t, cache.Put("ns", "other", "digest-b", write("bbbbbbbbbb")))
+
+	if _, err := ioutil.ReadFile(filepath.Join(entryDir, "data")); err != nil {
+		t.Fatalf("evict removed a cache entry that was pinned by an in-flight Get: %v", err)
+	}
+
+	cache.Release(entryDir)
+
+	require.NoError(t, cache.Put("ns", "yetanother", "digest-c", write("cccccccccc")))
+
+	if _, err := ioutil.ReadFile(filepath.Join(entryDir, "data")); err == nil {
+		t.Fatalf("expected unpinned entry to be evicted once its budget was exceeded again")
+	}
+}
+
+func TestLinkTreeHonoursCancellation(t *testing.T) {
+	src, remove := setupDownloadFolder(t)
+	defer remove()
+	require.NoError(t, os.MkdirAll(src, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644))
+
+	dest, removeDest := setupDownloadFolder(t)
+	defer removeDest()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := linkTree(ctx, src, dest)
+	assert.Error(t, err)
+}
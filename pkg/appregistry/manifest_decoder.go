@@ -0,0 +1,604 @@
+package appregistry
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/operator-framework/operator-registry/pkg/apprclient"
+)
+
+const (
+	// defaultMaxEntrySize bounds the uncompressed size of any single tar
+	// entry, guarding against decompression bombs hidden in a bundle.
+	defaultMaxEntrySize int64 = 100 << 20 // 100MiB
+
+	// defaultMaxTotalSize bounds the cumulative uncompressed size of all
+	// entries read out of one manifest's tarball.
+	defaultMaxTotalSize int64 = 1 << 30 // 1GiB
+)
+
+// windowsDrivePattern matches a leading Windows-style drive letter (e.g.
+// "C:\") that filepath.Clean on a POSIX system would otherwise leave
+// untouched.
+var windowsDrivePattern = regexp.MustCompile(`^[a-zA-Z]:[\\/]`)
+
+// Result captures the outcome of decoding a set of operator manifests
+// pulled from one or more registry sources.
+type Result struct {
+	mu sync.Mutex
+
+	// Flattened holds the raw bundle YAML for every manifest that shipped
+	// as a single, already-flattened document, keyed by "namespace/name".
+	Flattened map[string][]byte
+
+	// NestedDirectory is the root into which every non-flattened
+	// (multi-version, multi-file) bundle was extracted.
+	NestedDirectory string
+
+	FlattenedCount int
+	NestedCount    int
+
+	// CacheHits counts manifests served from the bundle cache instead of
+	// being re-extracted. See WithCache.
+	CacheHits int
+
+	// PerBundleErrors holds the decode error for every manifest that
+	// failed, keyed by "namespace/name", so one broken bundle doesn't
+	// hide the rest of a catalog pull.
+	PerBundleErrors map[string]error
+
+	// bundles tracks every "namespace/name" key already recorded by
+	// recordFlattened/recordNested, so a second manifest resolving to the
+	// same key (e.g. an OCI source and an appregistry source both
+	// claiming the same operator) is caught as a collision instead of
+	// silently overwriting the first one's result.
+	bundles map[string]bool
+}
+
+// claim reserves key for the caller, failing if another manifest already
+// recorded a result under it. Callers must hold r.mu.
+func (r *Result) claim(key string) error {
+	if r.bundles == nil {
+		r.bundles = map[string]bool{}
+	}
+	if r.bundles[key] {
+		return fmt.Errorf("duplicate bundle %s: already recorded from another source", key)
+	}
+	r.bundles[key] = true
+	return nil
+}
+
+func (r *Result) recordFlattened(key string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.claim(key); err != nil {
+		return err
+	}
+
+	if r.Flattened == nil {
+		r.Flattened = map[string][]byte{}
+	}
+	r.Flattened[key] = data
+	r.FlattenedCount++
+	return nil
+}
+
+func (r *Result) recordNested(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.claim(key); err != nil {
+		return err
+	}
+
+	r.NestedCount++
+	return nil
+}
+
+func (r *Result) recordCacheHit() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.CacheHits++
+}
+
+func (r *Result) recordError(key string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.PerBundleErrors[key] = err
+}
+
+// ociSourcePuller is the subset of ociclient.Client's behaviour
+// ManifestDecoder depends on, so an OCI-backed manifest source can be
+// substituted with a fake in tests without pulling in a registry client.
+type ociSourcePuller interface {
+	Pull(ctx context.Context, namespace, name, ref string) ([]*apprclient.OperatorMetadata, error)
+}
+
+type ociSource struct {
+	puller    ociSourcePuller
+	namespace string
+	name      string
+	ref       string
+}
+
+// DecoderOption configures optional behaviour of a ManifestDecoder.
+type DecoderOption func(*ManifestDecoder)
+
+// WithOCISource registers an additional manifest to be fetched from an
+// OCI-conformant registry, so a single Decode call can mix OCI-sourced
+// and appregistry-sourced bundles. Decode reads every pulled blob as an
+// uncompressed tar archive; it does not gunzip a blob or accept a bare
+// YAML document, so the raw layer content ociclient.Client.Pull returns
+// for MediaTypeNestedBundle and MediaTypeFlattenedBundle layers fails to
+// decode.
+func WithOCISource(puller ociSourcePuller, namespace, name, ref string) DecoderOption {
+	return func(d *ManifestDecoder) {
+		d.ociSources = append(d.ociSources, ociSource{
+			puller:    puller,
+			namespace: namespace,
+			name:      name,
+			ref:       ref,
+		})
+	}
+}
+
+// ManifestDecoder unpacks the tarball blobs returned by an app-registry
+// (or OCI) source into the on-disk layout the rest of operator-registry
+// expects: flattened bundles are kept in memory, nested bundles are
+// extracted under NestedDirectory.
+type ManifestDecoder struct {
+	logger          *logrus.Entry
+	nestedDirectory string
+	ociSources      []ociSource
+	maxEntrySize    int64
+	maxTotalSize    int64
+	cache           *BundleCache
+	cacheDir        string
+	cacheMaxSize    int64
+	concurrency     int
+}
+
+// WithCache enables a content-addressable cache of extracted bundle
+// trees at cacheDir, keyed by apprclient.RegistryMetadata.Digest so a
+// manifest that has not changed since the last Decode skips
+// re-extraction entirely. maxSize bounds the cache's total on-disk size,
+// in bytes, with least-recently-used entries evicted to make room; 0
+// disables eviction.
+func WithCache(cacheDir string, maxSize int64) DecoderOption {
+	return func(d *ManifestDecoder) {
+		d.cacheDir = cacheDir
+		d.cacheMaxSize = maxSize
+	}
+}
+
+// WithMaxEntrySize overrides the default limit on the uncompressed size
+// of any single tar entry.
+func WithMaxEntrySize(n int64) DecoderOption {
+	return func(d *ManifestDecoder) {
+		d.maxEntrySize = n
+	}
+}
+
+// WithMaxTotalSize overrides the default limit on the cumulative
+// uncompressed size of all entries read out of one manifest's tarball.
+func WithMaxTotalSize(n int64) DecoderOption {
+	return func(d *ManifestDecoder) {
+		d.maxTotalSize = n
+	}
+}
+
+// WithConcurrency overrides the number of manifests extracted in
+// parallel during Decode. It defaults to runtime.GOMAXPROCS(0).
+func WithConcurrency(n int) DecoderOption {
+	return func(d *ManifestDecoder) {
+		d.concurrency = n
+	}
+}
+
+// NewManifestDecoder returns a ManifestDecoder that extracts nested
+// bundles under nestedDirectory, creating it if it does not already
+// exist.
+func NewManifestDecoder(logger *logrus.Entry, nestedDirectory string, opts ...DecoderOption) (*ManifestDecoder, error) {
+	if nestedDirectory == "" {
+		return nil, fmt.Errorf("nested directory must be specified")
+	}
+
+	if err := os.MkdirAll(nestedDirectory, 0755); err != nil {
+		return nil, fmt.Errorf("create nested directory %s: %s", nestedDirectory, err)
+	}
+
+	decoder := &ManifestDecoder{
+		logger:          logger,
+		nestedDirectory: nestedDirectory,
+		maxEntrySize:    defaultMaxEntrySize,
+		maxTotalSize:    defaultMaxTotalSize,
+		concurrency:     runtime.GOMAXPROCS(0),
+	}
+
+	for _, opt := range opts {
+		opt(decoder)
+	}
+
+	if decoder.concurrency < 1 {
+		decoder.concurrency = 1
+	}
+
+	if decoder.cacheDir != "" {
+		cache, err := NewBundleCache(decoder.cacheDir, decoder.cacheMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		decoder.cache = cache
+	}
+
+	return decoder, nil
+}
+
+// Decode walks each manifest's tarball and classifies it as either a
+// flattened (single-file) bundle or a nested (multi-file) one, extracting
+// the latter onto disk under NestedDirectory. Any OCI sources registered
+// via WithOCISource are pulled and merged in alongside the appregistry
+// manifests passed in directly.
+//
+// Bundles are decoded concurrently, bounded by the decoder's configured
+// concurrency, and honour ctx: a cancelled ctx stops in-flight
+// extractions promptly and their partial output is cleaned up. A broken
+// bundle does not stop the others — failures are collected per-bundle in
+// Result.PerBundleErrors, and Decode returns a non-nil error only to
+// signal that PerBundleErrors is non-empty.
+func (d *ManifestDecoder) Decode(ctx context.Context, manifests []*apprclient.OperatorMetadata) (*Result, error) {
+	all := append([]*apprclient.OperatorMetadata{}, manifests...)
+
+	result := &Result{
+		NestedDirectory: d.nestedDirectory,
+		PerBundleErrors: map[string]error{},
+	}
+
+	for _, src := range d.ociSources {
+		blobs, err := src.puller.Pull(ctx, src.namespace, src.name, src.ref)
+		if err != nil {
+			result.recordError(fmt.Sprintf("%s/%s", src.namespace, src.name), fmt.Errorf("pull oci manifest %s: %w", src.ref, err))
+			continue
+		}
+
+		all = append(all, blobs...)
+	}
+
+	sem := make(chan struct{}, d.concurrency)
+	var wg sync.WaitGroup
+
+	for _, manifest := range all {
+		manifest := manifest
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			result.recordError(bundleKey(manifest), ctx.Err())
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := d.decodeManifest(ctx, manifest, result); err != nil {
+				result.recordError(bundleKey(manifest), err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if len(result.PerBundleErrors) > 0 {
+		return result, fmt.Errorf("%d of %d manifests failed to decode", len(result.PerBundleErrors), len(all))
+	}
+
+	return result, nil
+}
+
+func bundleKey(manifest *apprclient.OperatorMetadata) string {
+	return fmt.Sprintf("%s/%s", manifest.Namespace, manifest.Name)
+}
+
+// decodeManifest decodes a single manifest into result, consulting the
+// bundle cache first when one is configured.
+func (d *ManifestDecoder) decodeManifest(ctx context.Context, manifest *apprclient.OperatorMetadata, result *Result) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if d.cache != nil && manifest.Digest != "" {
+		if entryDir, hit := d.cache.Get(manifest.Namespace, manifest.Name, manifest.Digest); hit {
+			defer d.cache.Release(entryDir)
+
+			if err := d.applyCacheEntry(ctx, entryDir, manifest, result); err != nil {
+				return fmt.Errorf("apply cached manifest for %s/%s: %w", manifest.Namespace, manifest.Name, err)
+			}
+			result.recordCacheHit()
+			return nil
+		}
+	}
+
+	entries, err := readTar(ctx, bytes.NewReader(manifest.Blob), d.maxEntrySize, d.maxTotalSize)
+	if err != nil {
+		return fmt.Errorf("read manifest for %s/%s: %w", manifest.Namespace, manifest.Name, err)
+	}
+
+	if isFlattened(entries) {
+		if d.cache != nil && manifest.Digest != "" {
+			err := d.cache.Put(manifest.Namespace, manifest.Name, manifest.Digest, func(dir string) error {
+				return ioutil.WriteFile(filepath.Join(dir, flattenedCacheFile), entries[0].data, 0644)
+			})
+			if err != nil {
+				return fmt.Errorf("cache manifest for %s/%s: %w", manifest.Namespace, manifest.Name, err)
+			}
+		}
+
+		return result.recordFlattened(bundleKey(manifest), entries[0].data)
+	}
+
+	scratch, err := ioutil.TempDir(d.nestedDirectory, ".extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	if err := extractNested(ctx, entries, scratch); err != nil {
+		return fmt.Errorf("extract manifest for %s/%s: %w", manifest.Namespace, manifest.Name, err)
+	}
+
+	if d.cache != nil && manifest.Digest != "" {
+		err := d.cache.Put(manifest.Namespace, manifest.Name, manifest.Digest, func(dir string) error {
+			return linkTree(ctx, scratch, dir)
+		})
+		if err != nil {
+			return fmt.Errorf("cache manifest for %s/%s: %w", manifest.Namespace, manifest.Name, err)
+		}
+	}
+
+	if err := d.publish(ctx, scratch); err != nil {
+		return fmt.Errorf("materialize manifest for %s/%s: %w", manifest.Namespace, manifest.Name, err)
+	}
+
+	return result.recordNested(bundleKey(manifest))
+}
+
+// publish materialises a fully built bundle tree at src into
+// d.nestedDirectory. It first links src into a hidden staging directory
+// and only then renames each resulting file into place, so a cancelled
+// or otherwise failed link step only ever leaves partial state behind in
+// the (cleaned up) staging directory — nothing partial is ever visible
+// under nestedDirectory itself.
+func (d *ManifestDecoder) publish(ctx context.Context, src string) error {
+	staging, err := ioutil.TempDir(d.nestedDirectory, ".materialize-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if err := linkTree(ctx, src, staging); err != nil {
+		return err
+	}
+
+	return publishTree(staging, d.nestedDirectory)
+}
+
+// publishTree renames every file under staging into the matching path
+// under dest, creating intermediate directories as needed. Renames are
+// metadata-only on the same filesystem (staging is always a subdirectory
+// of dest), so this step is fast and not itself made cancellable.
+func publishTree(staging, dest string) error {
+	return filepath.Walk(staging, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(staging, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		target := filepath.Join(dest, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		return os.Rename(path, target)
+	})
+}
+
+// applyCacheEntry reads a cache entry back into result: a flattened
+// document is loaded into memory, a nested tree is hard-linked (falling
+// back to a copy) into nestedDirectory.
+func (d *ManifestDecoder) applyCacheEntry(ctx context.Context, entryDir string, manifest *apprclient.OperatorMetadata, result *Result) error {
+	if data, err := ioutil.ReadFile(filepath.Join(entryDir, flattenedCacheFile)); err == nil {
+		return result.recordFlattened(bundleKey(manifest), data)
+	}
+
+	if err := d.publish(ctx, entryDir); err != nil {
+		return err
+	}
+
+	return result.recordNested(bundleKey(manifest))
+}
+
+type tarEntry struct {
+	header *tar.Header
+	data   []byte
+}
+
+// ctxReader aborts a Read with ctx.Err() once ctx is done, so a long
+// io.Copy or ioutil.ReadAll notices cancellation between chunks instead
+// of running to completion regardless of ctx.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// readTar unpacks every entry of a tar stream into memory, rejecting
+// symlinks/hardlinks and enforcing per-entry and cumulative size limits
+// to guard against decompression bombs. Path validation against the
+// extraction root happens separately in extractNested, once an entry's
+// final on-disk target is known.
+func readTar(ctx context.Context, r io.Reader, maxEntrySize, maxTotalSize int64) ([]tarEntry, error) {
+	tr := tar.NewReader(ctxReader{ctx: ctx, r: r})
+
+	var entries []tarEntry
+	var total int64
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeSymlink, tar.TypeLink:
+			return nil, fmt.Errorf("%w: %s", ErrTarSymlink, header.Name)
+		default:
+			continue
+		}
+
+		if header.Size > maxEntrySize {
+			return nil, fmt.Errorf("%w: %s declares %d bytes, limit is %d", ErrTarTooLarge, header.Name, header.Size, maxEntrySize)
+		}
+
+		total += header.Size
+		if total > maxTotalSize {
+			return nil, fmt.Errorf("%w: cumulative manifest size exceeds limit of %d", ErrTarTooLarge, maxTotalSize)
+		}
+
+		// Read at most one byte beyond maxEntrySize so content that runs
+		// past the entry limit is reported rather than silently
+		// truncated.
+		data, err := ioutil.ReadAll(io.LimitReader(tr, maxEntrySize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > maxEntrySize {
+			return nil, fmt.Errorf("%w: %s exceeds limit of %d", ErrTarTooLarge, header.Name, maxEntrySize)
+		}
+
+		entries = append(entries, tarEntry{header: header, data: data})
+	}
+
+	return entries, nil
+}
+
+// isFlattened reports whether a bundle's tarball contains a single YAML
+// document (at any path inside the archive) rather than the
+// directory-per-version layout app-registry uses for nested bundles.
+func isFlattened(entries []tarEntry) bool {
+	if len(entries) != 1 {
+		return false
+	}
+
+	return filepath.Ext(entries[0].header.Name) == ".yaml"
+}
+
+func extractNested(ctx context.Context, entries []tarEntry, root string) error {
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		target, err := sanitizedTarget(root, entry.header.Name)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		if err := verifyWithinRoot(root, filepath.Dir(target)); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(target, entry.data, os.FileMode(entry.header.Mode)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sanitizedTarget resolves a tar entry's name against root and rejects
+// any that would escape it via "../" segments, an absolute path, or a
+// Windows-style drive letter.
+func sanitizedTarget(root, name string) (string, error) {
+	if windowsDrivePattern.MatchString(name) || filepath.IsAbs(name) {
+		return "", fmt.Errorf("%w: %s", ErrTarPathEscape, name)
+	}
+
+	cleaned := filepath.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", ErrTarPathEscape, name)
+	}
+
+	target := filepath.Join(root, cleaned)
+
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", ErrTarPathEscape, name)
+	}
+
+	return target, nil
+}
+
+// verifyWithinRoot resolves dir's real, symlink-free path and checks it
+// still falls under root. sanitizedTarget alone only inspects the
+// declared tar header name; this catches the case where an earlier
+// entry in the same archive planted a symlink at a path component we
+// are about to write through, a classic TOCTOU for tar extraction.
+func verifyWithinRoot(root, dir string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(realRoot, realDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s resolves outside %s", ErrTarPathEscape, dir, root)
+	}
+
+	return nil
+}
@@ -3,11 +3,15 @@ package appregistry
 import (
 	"archive/tar"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/operator-framework/operator-registry/pkg/apprclient"
@@ -85,7 +89,7 @@ func TestDecodeWithNestedBundleManifest(t *testing.T) {
 	decoder, err := NewManifestDecoder(logger, nestedDirectoryWant)
 	require.NoError(t, err)
 
-	resultGot, errGot := decoder.Decode(manifests)
+	resultGot, errGot := decoder.Decode(context.Background(), manifests)
 	assert.NoError(t, errGot)
 	assert.Nil(t, resultGot.Flattened)
 	assert.Equal(t, nestedDirectoryWant, resultGot.NestedDirectory)
@@ -108,7 +112,7 @@ func TestDecodeWithFlattenedManifest(t *testing.T) {
 	decoder, err := NewManifestDecoder(logger, nestedDirectoryWant)
 	require.NoError(t, err)
 
-	resultGot, errGot := decoder.Decode(manifests)
+	resultGot, errGot := decoder.Decode(context.Background(), manifests)
 	assert.NoError(t, errGot)
 	assert.NotNil(t, resultGot.Flattened)
 	assert.Equal(t, nestedDirectoryWant, resultGot.NestedDirectory)
@@ -140,7 +144,7 @@ func TestDecodeWithBothFlattenedAndNestedManifest(t *testing.T) {
 	decoder, err := NewManifestDecoder(logger, nestedDirectoryWant)
 	require.NoError(t, err)
 
-	resultGot, errGot := decoder.Decode(manifests)
+	resultGot, errGot := decoder.Decode(context.Background(), manifests)
 	assert.NoError(t, errGot)
 	assert.NotNil(t, resultGot.Flattened)
 	assert.Equal(t, nestedDirectoryWant, resultGot.NestedDirectory)
@@ -148,6 +152,55 @@ func TestDecodeWithBothFlattenedAndNestedManifest(t *testing.T) {
 	assert.Equal(t, 2, resultGot.NestedCount)
 }
 
+type fakeOCIPuller struct {
+	blobs []*apprclient.OperatorMetadata
+	err   error
+}
+
+func (f *fakeOCIPuller) Pull(ctx context.Context, namespace, name, ref string) ([]*apprclient.OperatorMetadata, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.blobs, nil
+}
+
+func TestDecodeWithOCISourcedManifest(t *testing.T) {
+	nestedDirectoryWant, remove := setupDownloadFolder(t)
+	defer remove()
+
+	manifests := []*apprclient.OperatorMetadata{
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: etcd,
+			Blob:             tarball(t, etcdManifestLocation, tarFilePrefixTrim),
+		},
+	}
+
+	puller := &fakeOCIPuller{
+		blobs: []*apprclient.OperatorMetadata{
+			&apprclient.OperatorMetadata{
+				RegistryMetadata: apprclient.RegistryMetadata{
+					Namespace: "mynamespace",
+					Name:      "descheduler",
+					Digest:    "sha256:deadbeef",
+				},
+				Blob: tarball(t, deschedulerManifestLocation, tarFilePrefixTrim),
+			},
+		},
+	}
+
+	logger := logrus.WithField("test", "oci")
+
+	decoder, err := NewManifestDecoder(logger, nestedDirectoryWant, WithOCISource(puller, "mynamespace", "descheduler", "example.com/mynamespace/descheduler:1.0.0"))
+	require.NoError(t, err)
+
+	resultGot, errGot := decoder.Decode(context.Background(), manifests)
+	assert.NoError(t, errGot)
+	assert.NotNil(t, resultGot.Flattened)
+	assert.Equal(t, nestedDirectoryWant, resultGot.NestedDirectory)
+	assert.Equal(t, 1, resultGot.FlattenedCount)
+	assert.Equal(t, 1, resultGot.NestedCount)
+}
+
 func tarball(t *testing.T, src string, trimPrefix string) (stream []byte) {
 	var b bytes.Buffer
 
@@ -210,3 +263,300 @@ func tarball(t *testing.T, src string, trimPrefix string) (stream []byte) {
 
 	return
 }
+
+// craftedTarball builds a tar stream from explicit headers, bypassing
+// filepath.Walk so headers that would never occur on a real filesystem
+// (path traversal, symlinks escaping the extraction root) can be tested.
+func craftedTarball(t *testing.T, headers []*tar.Header) []byte {
+	var b bytes.Buffer
+	writer := tar.NewWriter(&b)
+
+	for _, header := range headers {
+		require.NoError(t, writer.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := writer.Write([]byte("data"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, writer.Close())
+
+	return b.Bytes()
+}
+
+func TestDecodeRejectsPathTraversal(t *testing.T) {
+	nestedDirectoryWant, remove := setupDownloadFolder(t)
+	defer remove()
+
+	malicious := apprclient.RegistryMetadata{Namespace: "mynamespace", Name: "evil", Digest: "digest"}
+	manifests := []*apprclient.OperatorMetadata{
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: malicious,
+			Blob: craftedTarball(t, []*tar.Header{
+				{Name: "0.0.1/manifest.yaml", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+				{Name: "../../../etc/passwd", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+			}),
+		},
+	}
+
+	logger := logrus.WithField("test", "path-traversal")
+	decoder, err := NewManifestDecoder(logger, nestedDirectoryWant)
+	require.NoError(t, err)
+
+	resultGot, errGot := decoder.Decode(context.Background(), manifests)
+	require.Error(t, errGot)
+	require.Contains(t, resultGot.PerBundleErrors, "mynamespace/evil")
+	assert.True(t, errors.Is(resultGot.PerBundleErrors["mynamespace/evil"], ErrTarPathEscape))
+}
+
+func TestDecodeRejectsSymlinkEscape(t *testing.T) {
+	nestedDirectoryWant, remove := setupDownloadFolder(t)
+	defer remove()
+
+	malicious := apprclient.RegistryMetadata{Namespace: "mynamespace", Name: "evil", Digest: "digest"}
+	manifests := []*apprclient.OperatorMetadata{
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: malicious,
+			Blob: craftedTarball(t, []*tar.Header{
+				{Name: "0.0.1/link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+				{Name: "0.0.1/link/passwd", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+			}),
+		},
+	}
+
+	logger := logrus.WithField("test", "symlink-escape")
+	decoder, err := NewManifestDecoder(logger, nestedDirectoryWant)
+	require.NoError(t, err)
+
+	resultGot, errGot := decoder.Decode(context.Background(), manifests)
+	require.Error(t, errGot)
+	require.Contains(t, resultGot.PerBundleErrors, "mynamespace/evil")
+	assert.True(t, errors.Is(resultGot.PerBundleErrors["mynamespace/evil"], ErrTarSymlink))
+}
+
+func TestDecodeRejectsOversizedEntry(t *testing.T) {
+	nestedDirectoryWant, remove := setupDownloadFolder(t)
+	defer remove()
+
+	malicious := apprclient.RegistryMetadata{Namespace: "mynamespace", Name: "evil", Digest: "digest"}
+	manifests := []*apprclient.OperatorMetadata{
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: malicious,
+			Blob: craftedTarball(t, []*tar.Header{
+				{Name: "0.0.1/manifest.yaml", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+			}),
+		},
+	}
+
+	logger := logrus.WithField("test", "oversized")
+	decoder, err := NewManifestDecoder(logger, nestedDirectoryWant, WithMaxEntrySize(1))
+	require.NoError(t, err)
+
+	resultGot, errGot := decoder.Decode(context.Background(), manifests)
+	require.Error(t, errGot)
+	require.Contains(t, resultGot.PerBundleErrors, "mynamespace/evil")
+	assert.True(t, errors.Is(resultGot.PerBundleErrors["mynamespace/evil"], ErrTarTooLarge))
+}
+
+func TestDecodeUsesBundleCacheOnRepeatedDigest(t *testing.T) {
+	cacheDir, removeCache := setupDownloadFolder(t)
+	defer removeCache()
+
+	manifests := []*apprclient.OperatorMetadata{
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: etcd,
+			Blob:             tarball(t, etcdManifestLocation, tarFilePrefixTrim),
+		},
+	}
+
+	logger := logrus.WithField("test", "cache")
+
+	firstDirectory, removeFirst := setupDownloadFolder(t)
+	defer removeFirst()
+
+	decoder, err := NewManifestDecoder(logger, firstDirectory, WithCache(cacheDir, 0))
+	require.NoError(t, err)
+
+	firstResult, errGot := decoder.Decode(context.Background(), manifests)
+	require.NoError(t, errGot)
+	assert.Equal(t, 0, firstResult.CacheHits)
+	assert.Equal(t, 1, firstResult.NestedCount)
+
+	secondDirectory, removeSecond := setupDownloadFolder(t)
+	defer removeSecond()
+
+	decoder, err = NewManifestDecoder(logger, secondDirectory, WithCache(cacheDir, 0))
+	require.NoError(t, err)
+
+	secondResult, errGot := decoder.Decode(context.Background(), manifests)
+	require.NoError(t, errGot)
+	assert.Equal(t, 1, secondResult.CacheHits)
+	assert.Equal(t, 1, secondResult.NestedCount)
+}
+
+func TestDecodeAggregatesPerBundleErrors(t *testing.T) {
+	nestedDirectoryWant, remove := setupDownloadFolder(t)
+	defer remove()
+
+	malicious := apprclient.RegistryMetadata{Namespace: "mynamespace", Name: "evil", Digest: "digest"}
+	manifests := []*apprclient.OperatorMetadata{
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: etcd,
+			Blob:             tarball(t, etcdManifestLocation, tarFilePrefixTrim),
+		},
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: malicious,
+			Blob: craftedTarball(t, []*tar.Header{
+				{Name: "../../../etc/passwd", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+			}),
+		},
+	}
+
+	logger := logrus.WithField("test", "aggregate-errors")
+	decoder, err := NewManifestDecoder(logger, nestedDirectoryWant)
+	require.NoError(t, err)
+
+	resultGot, errGot := decoder.Decode(context.Background(), manifests)
+	require.Error(t, errGot)
+	assert.Equal(t, 1, resultGot.NestedCount)
+	require.Contains(t, resultGot.PerBundleErrors, "mynamespace/evil")
+	assert.True(t, errors.Is(resultGot.PerBundleErrors["mynamespace/evil"], ErrTarPathEscape))
+}
+
+func TestDecodeHonoursCancellation(t *testing.T) {
+	nestedDirectoryWant, remove := setupDownloadFolder(t)
+	defer remove()
+
+	manifests := []*apprclient.OperatorMetadata{
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: etcd,
+			Blob:             tarball(t, etcdManifestLocation, tarFilePrefixTrim),
+		},
+	}
+
+	logger := logrus.WithField("test", "cancel")
+	decoder, err := NewManifestDecoder(logger, nestedDirectoryWant)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	resultGot, errGot := decoder.Decode(ctx, manifests)
+	require.Error(t, errGot)
+	require.Contains(t, resultGot.PerBundleErrors, "mynamespace/etcd")
+	assert.True(t, errors.Is(resultGot.PerBundleErrors["mynamespace/etcd"], context.Canceled))
+
+	entries, err := ioutil.ReadDir(nestedDirectoryWant)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "cancelled decode should leave no partial output")
+}
+
+func TestDecodeRecordsFailedOCISourceWithoutDroppingOthers(t *testing.T) {
+	nestedDirectoryWant, remove := setupDownloadFolder(t)
+	defer remove()
+
+	manifests := []*apprclient.OperatorMetadata{
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: etcd,
+			Blob:             tarball(t, etcdManifestLocation, tarFilePrefixTrim),
+		},
+	}
+
+	puller := &fakeOCIPuller{err: fmt.Errorf("registry unreachable")}
+
+	logger := logrus.WithField("test", "oci-pull-failure")
+	decoder, err := NewManifestDecoder(logger, nestedDirectoryWant, WithOCISource(puller, "mynamespace", "descheduler", "example.com/mynamespace/descheduler:1.0.0"))
+	require.NoError(t, err)
+
+	resultGot, errGot := decoder.Decode(context.Background(), manifests)
+	require.Error(t, errGot)
+	assert.Equal(t, 1, resultGot.NestedCount)
+	require.Contains(t, resultGot.PerBundleErrors, "mynamespace/descheduler")
+}
+
+func TestDecodeRecordsCollisionWhenOCIAndAppRegistrySourcesShareKey(t *testing.T) {
+	nestedDirectoryWant, _ := setupDownloadFolder(t)
+
+	manifests := []*apprclient.OperatorMetadata{
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: descheduler,
+			Blob:             tarball(t, deschedulerManifestLocation, tarFilePrefixTrim),
+		},
+	}
+
+	puller := &fakeOCIPuller{
+		blobs: []*apprclient.OperatorMetadata{
+			&apprclient.OperatorMetadata{
+				RegistryMetadata: descheduler,
+				Blob:             tarball(t, deschedulerManifestLocation, tarFilePrefixTrim),
+			},
+		},
+	}
+
+	logger := logrus.WithField("test", "collision")
+	decoder, err := NewManifestDecoder(logger, nestedDirectoryWant, WithOCISource(puller, descheduler.Namespace, descheduler.Name, "example.com/mynamespace/descheduler:1.0.0"))
+	require.NoError(t, err)
+
+	resultGot, errGot := decoder.Decode(context.Background(), manifests)
+	require.Error(t, errGot)
+	assert.Equal(t, 1, resultGot.FlattenedCount, "only one of the two colliding sources should be recorded")
+	require.Contains(t, resultGot.PerBundleErrors, "mynamespace/descheduler")
+	assert.Contains(t, resultGot.PerBundleErrors["mynamespace/descheduler"].Error(), "duplicate bundle")
+}
+
+func TestDecodeWithSmallCacheBudgetUnderConcurrentLoad(t *testing.T) {
+	cacheDir, removeCache := setupDownloadFolder(t)
+	defer removeCache()
+
+	manifests := []*apprclient.OperatorMetadata{
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: etcd,
+			Blob:             tarball(t, etcdManifestLocation, tarFilePrefixTrim),
+		},
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: prometheus,
+			Blob:             tarball(t, prometheusManifestLocation, tarFilePrefixTrim),
+		},
+		&apprclient.OperatorMetadata{
+			RegistryMetadata: descheduler,
+			Blob:             tarball(t, deschedulerManifestLocation, tarFilePrefixTrim),
+		},
+	}
+
+	// A one-byte budget guarantees every Put forces evict() to run, so
+	// the concurrent decodes below are guaranteed to race a Get against
+	// an evict rather than merely exercise the cache's happy path.
+	const tinyCacheBudget = 1
+
+	logger := logrus.WithField("test", "cache-concurrency")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			downloadDir, remove := setupDownloadFolder(t)
+			defer remove()
+
+			decoder, err := NewManifestDecoder(logger, downloadDir, WithCache(cacheDir, tinyCacheBudget), WithConcurrency(4))
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			result, err := decoder.Decode(context.Background(), manifests)
+			if err != nil {
+				errs <- fmt.Errorf("%v (errors: %v)", err, result.PerBundleErrors)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent decode with small cache budget failed: %v", err)
+	}
+}
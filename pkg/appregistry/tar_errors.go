@@ -0,0 +1,20 @@
+package appregistry
+
+import "errors"
+
+var (
+	// ErrTarPathEscape is returned when a tar entry's name resolves to a
+	// path outside the extraction root, e.g. via "../" segments, an
+	// absolute path, or a Windows-style drive letter.
+	ErrTarPathEscape = errors.New("tar entry escapes extraction root")
+
+	// ErrTarSymlink is returned when a tar entry is a symlink or
+	// hardlink. Bundles are not expected to contain either, so they are
+	// refused outright rather than followed.
+	ErrTarSymlink = errors.New("tar entry is a symlink or hardlink")
+
+	// ErrTarTooLarge is returned when a tar entry, or the cumulative
+	// uncompressed size of all entries in a manifest, exceeds the
+	// configured limit.
+	ErrTarTooLarge = errors.New("tar entry exceeds size limit")
+)
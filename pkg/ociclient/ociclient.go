@@ -0,0 +1,141 @@
+// Package ociclient fetches operator bundles published as OCI artifacts
+// to a Docker-distribution-v2-conformant registry, yielding the same
+// apprclient.OperatorMetadata shape the appregistry pipeline consumes
+// from quay.io's app-registry API.
+package ociclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/operator-framework/operator-registry/pkg/apprclient"
+)
+
+const (
+	// MediaTypeNestedBundle identifies an OCI artifact layer carrying the
+	// directory-per-version bundle layout, equivalent to a nested
+	// appregistry tarball.
+	MediaTypeNestedBundle = "application/vnd.operatorframework.olm.bundle.manifests.v1.tar+gzip"
+
+	// MediaTypeFlattenedBundle identifies an OCI artifact layer carrying a
+	// single, already-flattened bundle document.
+	MediaTypeFlattenedBundle = "application/vnd.operatorframework.olm.bundle.manifests.flattened.v1.yaml"
+)
+
+// Client pulls operator bundles published as OCI artifacts from an
+// OCI-conformant registry.
+type Client struct {
+	resolver remotes.Resolver
+}
+
+// NewClient returns a Client backed by containerd's docker resolver with
+// default options. No credentials are configured, so requests to the
+// registry are made anonymously.
+func NewClient() *Client {
+	return &Client{
+		resolver: docker.NewResolver(docker.ResolverOptions{}),
+	}
+}
+
+// Pull resolves ref to an OCI manifest and returns one
+// apprclient.OperatorMetadata per bundle layer recognised by
+// MediaTypeNestedBundle/MediaTypeFlattenedBundle. Each Blob holds the
+// layer's content exactly as fetched: a nested layer is still
+// gzip-compressed and a flattened layer is a bare YAML document, not
+// repacked into a tarball like the blobs apprclient fetches from
+// app-registry. The returned RegistryMetadata.Digest is the layer's OCI
+// descriptor digest, not an opaque string.
+func (c *Client) Pull(ctx context.Context, namespace, name, ref string) ([]*apprclient.OperatorMetadata, error) {
+	resolvedRef, desc, err := c.resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %s", ref, err)
+	}
+
+	fetcher, err := c.resolver.Fetcher(ctx, resolvedRef)
+	if err != nil {
+		return nil, fmt.Errorf("fetcher for %s: %s", resolvedRef, err)
+	}
+
+	manifest, err := fetchManifest(ctx, fetcher, desc)
+	if err != nil {
+		return nil, fmt.Errorf("fetch manifest %s: %s", resolvedRef, err)
+	}
+
+	var blobs []*apprclient.OperatorMetadata
+	for _, layer := range manifest.Layers {
+		switch layer.MediaType {
+		case MediaTypeNestedBundle, MediaTypeFlattenedBundle:
+		default:
+			continue
+		}
+
+		data, err := fetchBlob(ctx, fetcher, layer)
+		if err != nil {
+			return nil, fmt.Errorf("fetch layer %s: %s", layer.Digest, err)
+		}
+
+		blobs = append(blobs, &apprclient.OperatorMetadata{
+			RegistryMetadata: apprclient.RegistryMetadata{
+				Namespace: namespace,
+				Name:      name,
+				Digest:    layer.Digest.String(),
+			},
+			Blob: data,
+		})
+	}
+
+	if len(blobs) == 0 {
+		return nil, fmt.Errorf("no recognised bundle layers in %s", resolvedRef)
+	}
+
+	return blobs, nil
+}
+
+func fetchManifest(ctx context.Context, fetcher remotes.Fetcher, desc specs.Descriptor) (*specs.Manifest, error) {
+	data, err := fetchVerified(ctx, fetcher, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest specs.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+func fetchBlob(ctx context.Context, fetcher remotes.Fetcher, desc specs.Descriptor) ([]byte, error) {
+	return fetchVerified(ctx, fetcher, desc)
+}
+
+// fetchVerified fetches desc's content via fetcher and verifies it hashes
+// to desc.Digest before returning it, so a compromised registry or a
+// man-in-the-middle can't smuggle arbitrary content in under a claimed
+// digest.
+func fetchVerified(ctx context.Context, fetcher remotes.Fetcher, desc specs.Descriptor) ([]byte, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	verifier := desc.Digest.Verifier()
+
+	data, err := io.ReadAll(io.TeeReader(rc, verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	if !verifier.Verified() {
+		return nil, fmt.Errorf("content for %s failed digest verification", desc.Digest)
+	}
+
+	return data, nil
+}
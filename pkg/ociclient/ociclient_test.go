@@ -0,0 +1,182 @@
+package ociclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver resolves every ref to a fixed manifest descriptor and hands
+// out a fakeFetcher that serves manifest/layer content from blobs keyed by
+// digest. tamperDigest/tamperedContent optionally make the fetcher serve
+// the wrong bytes for one digest, simulating a misbehaving registry or a
+// MITM proxy.
+type fakeResolver struct {
+	manifestDesc    specs.Descriptor
+	blobs           map[digest.Digest][]byte
+	fetchErr        error
+	tamperDigest    digest.Digest
+	tamperedContent []byte
+}
+
+func (r *fakeResolver) Resolve(ctx context.Context, ref string) (string, specs.Descriptor, error) {
+	return ref, r.manifestDesc, nil
+}
+
+func (r *fakeResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return &fakeFetcher{
+		blobs:           r.blobs,
+		err:             r.fetchErr,
+		tamperDigest:    r.tamperDigest,
+		tamperedContent: r.tamperedContent,
+	}, nil
+}
+
+func (r *fakeResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	return nil, fmt.Errorf("push not supported by fakeResolver")
+}
+
+type fakeFetcher struct {
+	blobs           map[digest.Digest][]byte
+	err             error
+	tamperDigest    digest.Digest
+	tamperedContent []byte
+}
+
+func (f *fakeFetcher) Fetch(ctx context.Context, desc specs.Descriptor) (io.ReadCloser, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	if f.tamperDigest != "" && desc.Digest == f.tamperDigest {
+		return ioutil.NopCloser(bytes.NewReader(f.tamperedContent)), nil
+	}
+
+	data, ok := f.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("no blob for digest %s", desc.Digest)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// layerFixture describes one manifest layer to synthesize in a test: its
+// media type and the content a well-behaved registry would serve for it.
+type layerFixture struct {
+	mediaType string
+	content   []byte
+}
+
+// newFakeClient builds a Client backed by a resolver whose manifest has
+// one layer per entry in layers, with each layer descriptor's digest
+// computed from its actual content so fetchVerified's check passes for
+// every well-behaved fixture.
+func newFakeClient(t *testing.T, layers []layerFixture) *Client {
+	t.Helper()
+
+	blobs := map[digest.Digest][]byte{}
+
+	var manifestLayers []specs.Descriptor
+	for _, l := range layers {
+		d := digest.FromBytes(l.content)
+		blobs[d] = l.content
+		manifestLayers = append(manifestLayers, specs.Descriptor{MediaType: l.mediaType, Digest: d})
+	}
+
+	manifestData, err := json.Marshal(specs.Manifest{Layers: manifestLayers})
+	require.NoError(t, err)
+
+	manifestDesc := specs.Descriptor{
+		MediaType: specs.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifestData),
+	}
+	blobs[manifestDesc.Digest] = manifestData
+
+	return &Client{
+		resolver: &fakeResolver{manifestDesc: manifestDesc, blobs: blobs},
+	}
+}
+
+func TestPullSkipsUnrecognisedMediaTypes(t *testing.T) {
+	layers := []layerFixture{
+		{mediaType: "application/vnd.docker.distribution.manifest.v1+json", content: []byte("not a bundle")},
+		{mediaType: MediaTypeFlattenedBundle, content: []byte("flattened bundle contents")},
+		{mediaType: MediaTypeNestedBundle, content: []byte("nested bundle contents")},
+	}
+
+	client := newFakeClient(t, layers)
+
+	got, err := client.Pull(context.Background(), "mynamespace", "etcd", "example.com/mynamespace/etcd:1.0.0")
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+
+	assert.Equal(t, []byte("flattened bundle contents"), got[0].Blob)
+	assert.Equal(t, []byte("nested bundle contents"), got[1].Blob)
+}
+
+func TestPullReturnsErrorWhenNoRecognisedLayers(t *testing.T) {
+	layers := []layerFixture{
+		{mediaType: "application/vnd.docker.distribution.manifest.v1+json", content: []byte("not a bundle")},
+	}
+
+	client := newFakeClient(t, layers)
+
+	_, err := client.Pull(context.Background(), "mynamespace", "etcd", "example.com/mynamespace/etcd:1.0.0")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no recognised bundle layers")
+}
+
+func TestPullPropagatesLayerDigestAndCoordinates(t *testing.T) {
+	content := []byte("nested bundle contents")
+	layers := []layerFixture{
+		{mediaType: MediaTypeNestedBundle, content: content},
+	}
+
+	client := newFakeClient(t, layers)
+
+	got, err := client.Pull(context.Background(), "mynamespace", "etcd", "example.com/mynamespace/etcd:1.0.0")
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+
+	assert.Equal(t, "mynamespace", got[0].Namespace)
+	assert.Equal(t, "etcd", got[0].Name)
+	assert.Equal(t, digest.FromBytes(content).String(), got[0].Digest)
+	assert.Equal(t, content, got[0].Blob)
+}
+
+func TestPullRejectsContentThatDoesNotMatchItsClaimedDigest(t *testing.T) {
+	content := []byte("nested bundle contents")
+	layerDigest := digest.FromBytes(content)
+
+	manifestLayers := []specs.Descriptor{{MediaType: MediaTypeNestedBundle, Digest: layerDigest}}
+	manifestData, err := json.Marshal(specs.Manifest{Layers: manifestLayers})
+	require.NoError(t, err)
+
+	manifestDesc := specs.Descriptor{
+		MediaType: specs.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifestData),
+	}
+
+	client := &Client{
+		resolver: &fakeResolver{
+			manifestDesc:    manifestDesc,
+			blobs:           map[digest.Digest][]byte{manifestDesc.Digest: manifestData},
+			tamperDigest:    layerDigest,
+			tamperedContent: []byte("substituted by a malicious registry"),
+		},
+	}
+
+	_, err = client.Pull(context.Background(), "mynamespace", "etcd", "example.com/mynamespace/etcd:1.0.0")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "digest verification")
+}